@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// bloomFilter is safe for concurrent add and test
+type bloomFilter struct {
+	bits   []uint64
+	m      uint32
+	hashes uint32
+}
+
+func newBloomFilter(expectedItems int, falsePositiveRate float64) *bloomFilter {
+	if expectedItems <= 0 {
+		expectedItems = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+
+	m := math.Ceil(-float64(expectedItems) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Max(1, math.Round(m/float64(expectedItems)*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint32(m)+63)/64),
+		m:      uint32(m),
+		hashes: uint32(hashes),
+	}
+}
+
+// locations use double hashing on the two halves of fnv-1a
+func (b *bloomFilter) locations(key string, fn func(idx uint32) bool) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	for i := uint32(0); i < b.hashes; i++ {
+		if !fn((h1 + i*h2) % b.m) {
+			return
+		}
+	}
+}
+
+func (b *bloomFilter) add(key string) {
+	b.locations(key, func(idx uint32) bool {
+		addr, mask := &b.bits[idx/64], uint64(1)<<(idx%64)
+		for {
+			old := atomic.LoadUint64(addr)
+			if old&mask != 0 || atomic.CompareAndSwapUint64(addr, old, old|mask) {
+				return true
+			}
+		}
+	})
+}
+
+func (b *bloomFilter) test(key string) bool {
+	found := true
+	b.locations(key, func(idx uint32) bool {
+		found = atomic.LoadUint64(&b.bits[idx/64])&(uint64(1)<<(idx%64)) != 0
+		return found
+	})
+	return found
+}
+
+func (b *bloomFilter) fillRatio() float64 {
+	set := 0
+	for i := range b.bits {
+		word := atomic.LoadUint64(&b.bits[i])
+		for ; word != 0; word &= word - 1 {
+			set++
+		}
+	}
+	return float64(set) / float64(b.m)
+}
+
+// bloom hold the filter of WithBloomFilter, next is filled alongside while
+// the filter is rebuilt so no key stored meanwhile is missed
+type bloom struct {
+	expectedItems     int
+	falsePositiveRate float64
+
+	current *bloomFilter
+	next    *bloomFilter
+	mux     sync.RWMutex
+}
+
+// WithBloomFilter track the string keys stored in the Cache, so MightContain
+// can rule out misses without a map lookup. The filter is rebuilt from the
+// live keys on every janitor tick (or Cleanup with WithExternalScheduler) to
+// drop the keys no longer stored.
+func WithBloomFilter(expectedItems int, falsePositiveRate float64) Option {
+	return func(c *cache) {
+		c.bloom = &bloom{
+			expectedItems:     expectedItems,
+			falsePositiveRate: falsePositiveRate,
+			current:           newBloomFilter(expectedItems, falsePositiveRate),
+		}
+	}
+}
+
+// MightContain return false only if the key is surely not stored. It is
+// advisory, always true without WithBloomFilter or for non-string keys.
+func (c *cache) MightContain(key interface{}) bool {
+	s, ok := key.(string)
+	if c.bloom == nil || !ok {
+		return true
+	}
+
+	c.bloom.mux.RLock()
+	defer c.bloom.mux.RUnlock()
+	return c.bloom.current.test(s)
+}
+
+// BloomFillRatio return the ratio of set bits of the filter, 0 without
+// WithBloomFilter
+func (c *cache) BloomFillRatio() float64 {
+	if c.bloom == nil {
+		return 0
+	}
+
+	c.bloom.mux.RLock()
+	defer c.bloom.mux.RUnlock()
+	return c.bloom.current.fillRatio()
+}
+
+// bloomStore record the key and run store while holding the filter, so a
+// rebuild installing its next filter waits for the store to land in the map
+func (c *cache) bloomStore(key interface{}, store func()) {
+	s, ok := key.(string)
+	if c.bloom == nil || !ok {
+		store()
+		return
+	}
+
+	c.bloom.mux.RLock()
+	defer c.bloom.mux.RUnlock()
+	c.bloom.current.add(s)
+	if c.bloom.next != nil {
+		c.bloom.next.add(s)
+	}
+	store()
+}
+
+// buildBloom return a filter of the string keys in m
+func (c *cache) buildBloom(m *sync.Map) *bloomFilter {
+	filter := newBloomFilter(c.bloom.expectedItems, c.bloom.falsePositiveRate)
+	fillBloom(filter, m)
+	return filter
+}
+
+func fillBloom(filter *bloomFilter, m *sync.Map) {
+	m.Range(func(k, v interface{}) bool {
+		if s, ok := k.(string); ok {
+			filter.add(s)
+		}
+		return true
+	})
+}
+
+// rebuildBloom replace the filter by one of the stored keys, it should run
+// inside write so the map isn't swapped meanwhile
+func (c *cache) rebuildBloom() {
+	next := newBloomFilter(c.bloom.expectedItems, c.bloom.falsePositiveRate)
+	c.bloom.mux.Lock()
+	c.bloom.next = next
+	c.bloom.mux.Unlock()
+
+	fillBloom(next, c.mapping())
+
+	c.bloom.mux.Lock()
+	c.bloom.current = next
+	c.bloom.next = nil
+	c.bloom.mux.Unlock()
+}
+
+// setBloom install a filter built by buildBloom
+func (c *cache) setBloom(filter *bloomFilter) {
+	c.bloom.mux.Lock()
+	c.bloom.current = filter
+	c.bloom.mux.Unlock()
+}
@@ -1,106 +1,1073 @@
 package cache
 
 import (
+	"context"
+	"errors"
+	"math/rand"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// swapMux serializes Swap between all caches
+var swapMux sync.Mutex
+
+// rangeCheckInterval is how many elements RangeContext visits between checks
+const rangeCheckInterval = 256
+
+var (
+	// ErrNotSlice is returned by Append when the payload isn't []interface{}
+	ErrNotSlice = errors.New("element payload is not a slice")
+	// ErrFrozen is returned by writes that return an error while frozen
+	ErrFrozen = errors.New("cache is frozen")
+	// ErrRejectedTTL is returned by Append when an absent element can't be
+	// created with its ttl
+	ErrRejectedTTL = errors.New("ttl is rejected")
+)
+
 // Cache store element with a expired time
 type Cache struct {
 	*cache
 }
 
+// Interface is the core read/write operations of Cache, so consumers can
+// accept it and inject a fake in their tests. Maintenance and diagnostics
+// methods are deliberately left out to keep fakes small.
+type Interface interface {
+	Put(key interface{}, payload interface{}, ttl time.Duration)
+	Get(key interface{}) interface{}
+	GetOrDefault(key interface{}, def interface{}) interface{}
+	GetWithExpire(key interface{}) (payload interface{}, expired time.Time)
+	LoadOrStore(key interface{}, payload interface{}, ttl time.Duration) (actual interface{}, loaded bool)
+}
+
+var _ Interface = (*Cache)(nil)
+
 type cache struct {
-	mapping sync.Map
+	// store holds the backing *sync.Map, see mapping
+	store   atomic.Value
 	janitor *janitor
+	// cleanupMux serializes cleanup passes between the janitor and CleanupNow
+	cleanupMux sync.Mutex
+	// paused is set by PauseCleanup to skip janitor ticks
+	paused int32
+	// deletes counts the deletions since the last Compact
+	deletes int64
+	// suppressed counts the Puts dropped by WithMinWriteInterval
+	suppressed uint64
+	// freezeMux is held for reading by every write, see write, and for
+	// writing by Freeze and Swap
+	freezeMux sync.RWMutex
+	frozen    bool
+	// mapMux is held by every write, so a compareAndSwap or
+	// compareAndDelete cannot interleave with another Store
+	mapMux sync.Mutex
+	// keyLocks holds the per-key locks of WithLock, guarded by keyLocksMux
+	keyLocks    map[interface{}]*keyLock
+	keyLocksMux sync.Mutex
+
+	logger  func(level, msg string, fields map[string]interface{})
+	history *eventRing
+	name    string
+
+	zeroTTLPermanent bool
+	jitter           time.Duration
+	externalJanitor  bool
+	tiers            []*tier
+	autoCompact      int64
+	bloom            *bloom
+	minWriteInterval time.Duration
+	heapTarget       uint64
+	heapInterval     time.Duration
+	rand             *rand.Rand
+	randMux          sync.Mutex
+	encoder          func(interface{}) interface{}
+	decoder          func(interface{}) interface{}
+	codec            Codec
+	weightedTTL      func(interface{}, time.Duration) time.Duration
+}
+
+// Option is used to customize the Cache created by New
+type Option func(*cache)
+
+// WithLogger set a hook called on notable events such as janitor
+// start/stop and eviction batches
+func WithLogger(logger func(level, msg string, fields map[string]interface{})) Option {
+	return func(c *cache) {
+		c.logger = logger
+	}
+}
+
+// WithName label the Cache, the name is added to logger fields
+func WithName(name string) Option {
+	return func(c *cache) {
+		c.name = name
+	}
+}
+
+// Name return the label set by WithName
+func (c *cache) Name() string {
+	return c.name
+}
+
+// WithCleanupJitter delay the first janitor tick by a random duration up to d,
+// so janitors of caches created together don't sweep in lockstep
+func WithCleanupJitter(d time.Duration) Option {
+	return func(c *cache) {
+		c.jitter = d
+	}
+}
+
+// WithExternalScheduler don't start the janitor goroutine, the caller is
+// expected to call Cleanup on its own schedule
+func WithExternalScheduler() Option {
+	return func(c *cache) {
+		c.externalJanitor = true
+	}
+}
+
+// WithHeapTarget make the janitor check the heap every checkInterval, and
+// drop the soonest-to-expire elements while the heap in use exceeds bytes or
+// until the Cache is empty. The heap is the whole process's, so bytes is a
+// process level budget. It has no effect with WithExternalScheduler.
+func WithHeapTarget(bytes uint64, checkInterval time.Duration) Option {
+	return func(c *cache) {
+		c.heapTarget = bytes
+		c.heapInterval = checkInterval
+	}
+}
+
+// heapTrimPercent is how much TrimToPercent keeps on every heap target step
+const heapTrimPercent = 0.75
+
+func (c *cache) shedHeap() {
+	stats := runtime.MemStats{}
+	dropped := 0
+	for {
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse <= c.heapTarget {
+			break
+		}
+
+		n := 0
+		c.write(func() {
+			n = c.trimToPercent(heapTrimPercent)
+		})
+		if n == 0 {
+			break
+		}
+		dropped += n
+		runtime.GC()
+	}
+
+	if dropped > 0 {
+		c.log("warn", "heap target exceeded, trimmed elements", map[string]interface{}{
+			"count":      dropped,
+			"heap_inuse": stats.HeapInuse,
+		})
+	}
 }
 
+// WithAutoCompact make every janitor tick (or Cleanup with
+// WithExternalScheduler) Compact the Cache once deletedThreshold
+// elements are deleted since the last Compact, to bound the memory kept by
+// sync.Map under heavy key churn
+func WithAutoCompact(deletedThreshold int) Option {
+	return func(c *cache) {
+		c.autoCompact = int64(deletedThreshold)
+	}
+}
+
+// WithMinWriteInterval drop a Put arriving sooner than d after the last
+// accepted Put of the same live element, the dropped value is not applied
+// later. SuppressedWrites reports how many Puts are dropped.
+func WithMinWriteInterval(d time.Duration) Option {
+	return func(c *cache) {
+		c.minWriteInterval = d
+	}
+}
+
+// SuppressedWrites return how many Puts are dropped by WithMinWriteInterval
+func (c *cache) SuppressedWrites() uint64 {
+	return atomic.LoadUint64(&c.suppressed)
+}
+
+// WithRand set the random source used by the Cache for jitter and Warm
+func WithRand(r *rand.Rand) Option {
+	return func(c *cache) {
+		c.rand = r
+	}
+}
+
+// int63n is rand.Int63n on the source of WithRand, which isn't safe for
+// concurrent use on its own
+func (c *cache) int63n(n int64) int64 {
+	if c.rand == nil {
+		return rand.Int63n(n)
+	}
+	c.randMux.Lock()
+	defer c.randMux.Unlock()
+	return c.rand.Int63n(n)
+}
+
+// WithZeroTTLMeansPermanent decide how a ttl <= 0 is handled. When true,
+// such element never expires; otherwise (the default) the Put is ignored
+// and LoadOrStore only loads.
+func WithZeroTTLMeansPermanent(permanent bool) Option {
+	return func(c *cache) {
+		c.zeroTTLPermanent = permanent
+	}
+}
+
+// WithValueEncoder set a hook applied to payloads before they are stored,
+// e.g. to compress or encrypt them. Payloads are kept encoded in memory, so
+// anything reading the stored elements directly (such as a persistence
+// codec) sees the encoded form.
+func WithValueEncoder(encoder func(interface{}) interface{}) Option {
+	return func(c *cache) {
+		c.encoder = encoder
+	}
+}
+
+// WithValueDecoder set a hook applied to stored payloads before they are
+// returned, it should reverse WithValueEncoder
+func WithValueDecoder(decoder func(interface{}) interface{}) Option {
+	return func(c *cache) {
+		c.decoder = decoder
+	}
+}
+
+// Codec convert payloads to and from bytes
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+// WithValueSerialization store every payload as the []byte marshaled by the
+// codec, trading CPU on Put and Get for compact memory. The codec runs
+// before WithValueEncoder on Put and after WithValueDecoder on Get, a Put
+// failing to marshal is dropped and a Get failing to unmarshal is a miss.
+func WithValueSerialization(codec Codec) Option {
+	return func(c *cache) {
+		c.codec = codec
+	}
+}
+
+func (c *cache) encode(payload interface{}) (interface{}, error) {
+	if c.codec != nil {
+		data, err := c.codec.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload = data
+	}
+	if c.encoder != nil {
+		payload = c.encoder(payload)
+	}
+	return payload, nil
+}
+
+func (c *cache) decode(payload interface{}) (interface{}, error) {
+	if c.decoder != nil {
+		payload = c.decoder(payload)
+	}
+	if c.codec != nil {
+		data, ok := payload.([]byte)
+		if !ok {
+			return nil, errors.New("serialized payload is not []byte")
+		}
+		return c.codec.Unmarshal(data)
+	}
+	return payload, nil
+}
+
+// decodeElement return the payload of elm, and log when it can't be decoded
+func (c *cache) decodeElement(elm *element) (interface{}, bool) {
+	payload, err := c.decode(elm.Payload)
+	if err != nil {
+		c.log("error", "decode payload failed", map[string]interface{}{"error": err})
+		return nil, false
+	}
+	return payload, true
+}
+
+// WithSizeWeightedTTL set a hook deriving the effective ttl of Put and
+// LoadOrStore from the payload and the requested ttl, e.g. to expire large
+// payloads sooner. TouchPrefix uses the requested ttl unadjusted.
+func WithSizeWeightedTTL(fn func(v interface{}, baseTTL time.Duration) time.Duration) Option {
+	return func(c *cache) {
+		c.weightedTTL = fn
+	}
+}
+
+func (c *cache) ttlFor(payload interface{}, ttl time.Duration) time.Duration {
+	if c.weightedTTL == nil {
+		return ttl
+	}
+	return c.weightedTTL(payload, ttl)
+}
+
+// element with a zero Expired never expires, Stored is only set with
+// WithMinWriteInterval
 type element struct {
 	Expired time.Time
+	Stored  time.Time
 	Payload interface{}
 }
 
-// Put element in Cache with its ttl
-func (c *cache) Put(key interface{}, payload interface{}, ttl time.Duration) {
-	c.mapping.Store(key, &element{
+func (e *element) isExpired(now time.Time) bool {
+	return !e.Expired.IsZero() && now.After(e.Expired)
+}
+
+// newElement return false when the ttl is rejected
+func (c *cache) newElement(payload interface{}, ttl time.Duration) (*element, bool) {
+	if ttl <= 0 {
+		if !c.zeroTTLPermanent {
+			return nil, false
+		}
+		return &element{Payload: payload}, true
+	}
+	return &element{
 		Payload: payload,
 		Expired: time.Now().Add(ttl),
+	}, true
+}
+
+// Put element in Cache with its ttl, see WithZeroTTLMeansPermanent for ttl <= 0
+func (c *cache) Put(key interface{}, payload interface{}, ttl time.Duration) {
+	c.put(key, payload, ttl)
+}
+
+// put return the stored element, or false if nothing is stored
+func (c *cache) put(key interface{}, payload interface{}, ttl time.Duration) (*element, bool) {
+	stored, err := c.encode(payload)
+	if err != nil {
+		c.log("error", "encode payload failed", map[string]interface{}{"error": err})
+		return nil, false
+	}
+	elm, ok := c.newElement(stored, c.ttlFor(payload, ttl))
+	if !ok {
+		return nil, false
+	}
+	if c.minWriteInterval <= 0 {
+		return elm, c.write(func() {
+			c.bloomStore(key, func() {
+				c.mapping().Store(key, elm)
+			})
+		})
+	}
+
+	accepted := false
+	elm.Stored = time.Now()
+	c.write(func() {
+		c.bloomStore(key, func() {
+			accepted = c.storeThrottled(key, elm)
+		})
 	})
+	return elm, accepted
+}
+
+// storeThrottled store elm unless the live element was stored less than
+// minWriteInterval ago
+func (c *cache) storeThrottled(key interface{}, elm *element) bool {
+	for {
+		item, exist := c.mapping().LoadOrStore(key, elm)
+		if !exist {
+			return true
+		}
+		old := item.(*element)
+		if !old.isExpired(elm.Stored) && elm.Stored.Sub(old.Stored) < c.minWriteInterval {
+			atomic.AddUint64(&c.suppressed, 1)
+			return false
+		}
+		if c.compareAndSwap(key, old, elm) {
+			return true
+		}
+	}
+}
+
+// Entry is an element to Put with its ttl
+type Entry struct {
+	Key     interface{}
+	Payload interface{}
+	TTL     time.Duration
+}
+
+// Warm Put entries with their ttl extended by a uniform random duration in
+// [0, spread), so elements seeded together don't expire together. A ttl <= 0
+// is not spread, see WithZeroTTLMeansPermanent.
+func (c *cache) Warm(entries []Entry, spread time.Duration) {
+	for _, entry := range entries {
+		ttl := entry.TTL
+		if spread > 0 && ttl > 0 {
+			ttl += time.Duration(c.int63n(int64(spread)))
+		}
+		c.Put(entry.Key, entry.Payload, ttl)
+	}
 }
 
 // Get element in Cache, and drop when it expired
 func (c *cache) Get(key interface{}) interface{} {
-	item, exist := c.mapping.Load(key)
+	elm, exist := c.load(key)
 	if !exist {
 		return nil
 	}
-	elm := item.(*element)
-	// expired
-	if time.Since(elm.Expired) > 0 {
-		c.mapping.Delete(key)
-		return nil
+	payload, _ := c.decodeElement(elm)
+	return payload
+}
+
+// GetOrDefault return the live element in Cache, or def without storing it
+func (c *cache) GetOrDefault(key interface{}, def interface{}) interface{} {
+	elm, exist := c.load(key)
+	if !exist {
+		return def
 	}
-	return elm.Payload
+	if payload, ok := c.decodeElement(elm); ok {
+		return payload
+	}
+	return def
 }
 
-// GetWithExpire element in Cache with Expire Time
+// GetWithExpire element in Cache with Expire Time, a zero Expire Time means
+// the element never expires
 func (c *cache) GetWithExpire(key interface{}) (payload interface{}, expired time.Time) {
-	item, exist := c.mapping.Load(key)
+	elm, exist := c.load(key)
 	if !exist {
 		return
 	}
+	if payload, ok := c.decodeElement(elm); ok {
+		return payload, elm.Expired
+	}
+	return
+}
+
+// GetExpired return the element even if it expired but is not dropped yet,
+// it intentionally bypasses the expiration of Get and never drops elements
+func (c *cache) GetExpired(key interface{}) (value interface{}, expired bool, present bool) {
+	item, exist := c.mapping().Load(key)
+	if !exist {
+		return nil, false, false
+	}
+	elm := item.(*element)
+	payload, ok := c.decodeElement(elm)
+	if !ok {
+		return nil, false, false
+	}
+	return payload, elm.isExpired(time.Now()), true
+}
+
+// load return the live element, and drop it when it expired
+func (c *cache) load(key interface{}) (*element, bool) {
+	item, exist := c.mapping().Load(key)
+	if !exist {
+		return nil, false
+	}
 	elm := item.(*element)
 	// expired
-	if time.Since(elm.Expired) > 0 {
-		c.mapping.Delete(key)
+	if elm.isExpired(time.Now()) {
+		c.write(func() {
+			// the element may be replaced by LoadOrStore since it was loaded
+			if c.compareAndDelete(key, elm) {
+				atomic.AddInt64(&c.deletes, 1)
+			}
+		})
+		return nil, false
+	}
+	return elm, true
+}
+
+// LoadOrStore returns the existing live element for the key if present.
+// Otherwise, it stores and returns the given payload with its ttl, an
+// expired element is replaced as if it were absent.
+// The loaded result is true if the payload was loaded, false if stored.
+// When the ttl is rejected or the Cache is frozen, nothing is stored and
+// actual is nil on a miss.
+func (c *cache) LoadOrStore(key interface{}, payload interface{}, ttl time.Duration) (actual interface{}, loaded bool) {
+	var elm *element
+	stored, err := c.encode(payload)
+	ok := err == nil
+	if ok {
+		elm, ok = c.newElement(stored, c.ttlFor(payload, ttl))
+	} else {
+		c.log("error", "encode payload failed", map[string]interface{}{"error": err})
+	}
+	store := func() {
+		c.bloomStore(key, func() {
+			actual, loaded = c.loadOrStore(key, elm)
+		})
+	}
+	if !ok || !c.write(store) {
+		if actual = c.Get(key); actual != nil {
+			return actual, true
+		}
+		return nil, false
+	}
+	if loaded {
+		actual, _ = c.decodeElement(&element{Payload: actual})
+		return actual, true
+	}
+	return payload, false
+}
+
+// loadOrStore return the stored payload of the live element, or store elm
+func (c *cache) loadOrStore(key interface{}, elm *element) (interface{}, bool) {
+	for {
+		item, exist := c.mapping().LoadOrStore(key, elm)
+		if !exist {
+			return elm.Payload, false
+		}
+		old := item.(*element)
+		if !old.isExpired(time.Now()) {
+			return old.Payload, true
+		}
+		// expired, replace it unless someone else did first
+		if c.compareAndSwap(key, old, elm) {
+			return elm.Payload, false
+		}
+	}
+}
+
+// Append atomically append items to the []interface{} payload of the key.
+// An absent or expired element is created with a ttl of 0, so without
+// WithZeroTTLMeansPermanent it returns ErrRejectedTTL, see AppendBounded.
+func (c *cache) Append(key interface{}, items ...interface{}) error {
+	return c.AppendBounded(key, 0, 0, items...)
+}
+
+// AppendBounded atomically append items to the []interface{} payload of the
+// key and keep at most max newest items, max <= 0 means unbounded.
+// The ttl of a live element is preserved, an absent or expired element is
+// created with ttl like Put.
+// Return ErrNotSlice if the payload isn't a slice, ErrRejectedTTL if the ttl
+// of the created element is rejected, ErrFrozen if the Cache is frozen, or
+// the error of WithValueSerialization.
+func (c *cache) AppendBounded(key interface{}, max int, ttl time.Duration, items ...interface{}) error {
+	for {
+		item, exist := c.mapping().Load(key)
+		var old *element
+		var slice []interface{}
+		live := exist && !item.(*element).isExpired(time.Now())
+		if live {
+			old = item.(*element)
+			payload, err := c.decode(old.Payload)
+			if err != nil {
+				return err
+			}
+			s, ok := payload.([]interface{})
+			if !ok {
+				return ErrNotSlice
+			}
+			slice = s
+		}
+
+		// copy on write, readers may still hold the old slice
+		next := make([]interface{}, 0, len(slice)+len(items))
+		next = append(append(next, slice...), items...)
+		if max > 0 && len(next) > max {
+			next = next[len(next)-max:]
+		}
+		payload, err := c.encode(next)
+		if err != nil {
+			return err
+		}
+		elm := &element{Payload: payload}
+		if live {
+			elm.Expired = old.Expired
+		} else {
+			var ok bool
+			if elm, ok = c.newElement(payload, ttl); !ok {
+				return ErrRejectedTTL
+			}
+		}
+
+		stored := false
+		ok := c.write(func() {
+			c.bloomStore(key, func() {
+				if exist {
+					stored = c.compareAndSwap(key, item.(*element), elm)
+				} else {
+					_, loaded := c.mapping().LoadOrStore(key, elm)
+					stored = !loaded
+				}
+			})
+		})
+		if !ok {
+			return ErrFrozen
+		}
+		if stored {
+			return nil
+		}
+	}
+}
+
+// keyLock is dropped from keyLocks once no caller holds or waits for it
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// WithLock run fn with the current value of the key under a per-key lock,
+// and Put the returned value with its ttl if store is true. Calls for the
+// same key are serialized, but Get, Put and other operations don't take the
+// lock. value is the one readers see, so fn must return a new value instead
+// of mutating value in place. The Put follows the usual rules: a rejected
+// ttl, WithMinWriteInterval or a frozen Cache silently drop the update.
+func (c *cache) WithLock(key interface{}, fn func(value interface{}, exists bool) (newValue interface{}, ttl time.Duration, store bool)) {
+	l := c.lockKey(key)
+	defer c.unlockKey(key, l)
+
+	var value interface{}
+	elm, exist := c.load(key)
+	if exist {
+		value, exist = c.decodeElement(elm)
+	}
+	if newValue, ttl, store := fn(value, exist); store {
+		c.Put(key, newValue, ttl)
+	}
+}
+
+func (c *cache) lockKey(key interface{}) *keyLock {
+	c.keyLocksMux.Lock()
+	if c.keyLocks == nil {
+		c.keyLocks = map[interface{}]*keyLock{}
+	}
+	l, exist := c.keyLocks[key]
+	if !exist {
+		l = &keyLock{}
+		c.keyLocks[key] = l
+	}
+	l.refs++
+	c.keyLocksMux.Unlock()
+
+	l.Lock()
+	return l
+}
+
+func (c *cache) unlockKey(key interface{}, l *keyLock) {
+	l.Unlock()
+
+	c.keyLocksMux.Lock()
+	l.refs--
+	if l.refs == 0 {
+		delete(c.keyLocks, key)
+	}
+	c.keyLocksMux.Unlock()
+}
+
+// TouchPrefix renew the ttl of live elements whose string key has the prefix,
+// and return how many elements are renewed
+func (c *cache) TouchPrefix(prefix string, ttl time.Duration) int {
+	touched := 0
+	c.write(func() {
+		c.touchPrefix(prefix, ttl, &touched)
+	})
+	return touched
+}
+
+func (c *cache) touchPrefix(prefix string, ttl time.Duration, touched *int) {
+	now := time.Now()
+	c.mapping().Range(func(k, v interface{}) bool {
+		key, ok := k.(string)
+		if !ok || !strings.HasPrefix(key, prefix) {
+			return true
+		}
+		old := v.(*element)
+		if old.isExpired(now) {
+			return true
+		}
+		elm, ok := c.newElement(old.Payload, ttl)
+		if !ok {
+			return false
+		}
+		if c.compareAndSwap(k, old, elm) {
+			*touched++
+		}
+		return true
+	})
+}
+
+// OrderedKeys return the keys of live elements. The cache does not track
+// insertion order, so the keys are returned in unspecified order.
+func (c *cache) OrderedKeys() []interface{} {
+	keys := []interface{}{}
+	now := time.Now()
+	c.mapping().Range(func(k, v interface{}) bool {
+		if !v.(*element).isExpired(now) {
+			keys = append(keys, k)
+		}
+		return true
+	})
+	return keys
+}
+
+// RangeContext calls fn for each live element until fn returns false or ctx
+// is done, ctx is checked before the first element and then every
+// rangeCheckInterval elements, and its error is returned
+func (c *cache) RangeContext(ctx context.Context, fn func(key, value interface{}) bool) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	visited := 0
+	now := time.Now()
+	c.mapping().Range(func(k, v interface{}) bool {
+		visited++
+		if visited%rangeCheckInterval == 0 {
+			if err = ctx.Err(); err != nil {
+				return false
+			}
+		}
+		elm := v.(*element)
+		if elm.isExpired(now) {
+			return true
+		}
+		payload, ok := c.decodeElement(elm)
+		if !ok {
+			return true
+		}
+		return fn(k, payload)
+	})
+	return err
+}
+
+// RangeExpiringWithin calls fn for each live element which expires within d,
+// Range stops if fn returns false
+func (c *cache) RangeExpiringWithin(d time.Duration, fn func(key, value interface{}) bool) {
+	now := time.Now()
+	deadline := now.Add(d)
+	c.mapping().Range(func(k, v interface{}) bool {
+		elm := v.(*element)
+		if elm.Expired.IsZero() || elm.Expired.Before(now) || elm.Expired.After(deadline) {
+			return true
+		}
+		payload, ok := c.decodeElement(elm)
+		if !ok {
+			return true
+		}
+		return fn(k, payload)
+	})
+}
+
+func (c *cache) log(level, msg string, fields map[string]interface{}) {
+	if c.logger == nil && c.history == nil {
 		return
 	}
-	return elm.Payload, elm.Expired
+	if c.name != "" {
+		if fields == nil {
+			fields = map[string]interface{}{}
+		}
+		fields["name"] = c.name
+	}
+	if c.history != nil {
+		c.history.add(Event{Time: time.Now(), Level: level, Message: msg, Fields: fields})
+	}
+	if c.logger != nil {
+		c.logger(level, msg, fields)
+	}
+}
+
+// CleanupNow drop all expired elements immediately without waiting for the
+// janitor, it is safe to call concurrently with the janitor
+func (c *cache) CleanupNow() {
+	c.cleanup()
+}
+
+// Cleanup run a janitor tick: the sweep and the maintenance configured by
+// options such as WithAutoCompact. It is meant for WithExternalScheduler,
+// and respects PauseCleanup unlike CleanupNow.
+func (c *cache) Cleanup() {
+	if atomic.LoadInt32(&c.paused) == 0 {
+		c.tick()
+	}
+}
+
+// tick is the body of a janitor tick
+func (c *cache) tick() {
+	c.cleanup()
+	// drop the index entries of elements swept above
+	for _, t := range c.tiers {
+		t.cleanup(c)
+	}
+	if c.autoCompact > 0 && atomic.LoadInt64(&c.deletes) >= c.autoCompact {
+		c.Compact()
+	}
+	if c.bloom != nil {
+		c.write(c.rebuildBloom)
+	}
+}
+
+// PauseCleanup suspend the janitor sweep, Get still drops expired elements
+func (c *cache) PauseCleanup() {
+	atomic.StoreInt32(&c.paused, 1)
+}
+
+// ResumeCleanup resume the janitor sweep, elements expired during the pause
+// are dropped by the next sweep
+func (c *cache) ResumeCleanup() {
+	atomic.StoreInt32(&c.paused, 0)
+}
+
+// TrimToPercent drop the soonest-to-expire elements until at most p (0 to 1)
+// of the current elements remain, elements without expiration go last.
+// Return how many elements are dropped.
+func (c *cache) TrimToPercent(p float64) int {
+	dropped := 0
+	c.write(func() {
+		dropped = c.trimToPercent(p)
+	})
+	if dropped > 0 {
+		c.log("info", "trimmed elements", map[string]interface{}{"count": dropped})
+	}
+	return dropped
+}
+
+type trimCandidate struct {
+	key interface{}
+	elm *element
+}
+
+func (c *cache) trimToPercent(p float64) int {
+	candidates := []trimCandidate{}
+	c.mapping().Range(func(k, v interface{}) bool {
+		candidates = append(candidates, trimCandidate{k, v.(*element)})
+		return true
+	})
+
+	if p < 0 {
+		p = 0
+	}
+	keep := int(float64(len(candidates)) * p)
+	if keep >= len(candidates) {
+		return 0
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].elm.Expired, candidates[j].elm.Expired
+		if a.IsZero() || b.IsZero() {
+			return !a.IsZero()
+		}
+		return a.Before(b)
+	})
+
+	dropped := 0
+	for _, candidate := range candidates[:len(candidates)-keep] {
+		if c.compareAndDelete(candidate.key, candidate.elm) {
+			dropped++
+		}
+	}
+	atomic.AddInt64(&c.deletes, int64(dropped))
+	return dropped
+}
+
+// Freeze make writes no-ops (or return ErrFrozen) and stop dropping expired
+// elements, so the content stays stable until Unfreeze. In-flight writes
+// finish before Freeze returns.
+func (c *cache) Freeze() {
+	c.freezeMux.Lock()
+	c.frozen = true
+	c.freezeMux.Unlock()
+}
+
+// Unfreeze resume writes and drop the elements expired while frozen
+func (c *cache) Unfreeze() {
+	c.freezeMux.Lock()
+	c.frozen = false
+	c.freezeMux.Unlock()
+	c.cleanup()
+}
+
+// Swap atomically exchange the backing map with other's, so readers never
+// see a partially replaced content. Elements keep their expiry and are
+// expected to be stored with the same options in both caches. Writes are
+// held off during the exchange, but a Get already in flight may still
+// return an element from the displaced map. Swap is a no-op while either
+// cache is frozen.
+func (c *cache) Swap(other *Cache) {
+	// two caches swapping with each other would lock in opposite order
+	swapMux.Lock()
+	defer swapMux.Unlock()
+
+	c.freezeMux.Lock()
+	defer c.freezeMux.Unlock()
+	if c.frozen || other.cache == c {
+		return
+	}
+
+	other.freezeMux.Lock()
+	defer other.freezeMux.Unlock()
+	if other.frozen {
+		return
+	}
+	mine, theirs := c.mapping(), other.mapping()
+	// the filters must cover the new keys before readers see them
+	if c.bloom != nil {
+		c.setBloom(c.buildBloom(theirs))
+	}
+	if other.bloom != nil {
+		other.setBloom(other.buildBloom(mine))
+	}
+	c.store.Store(theirs)
+	other.store.Store(mine)
+}
+
+func (c *cache) mapping() *sync.Map {
+	return c.store.Load().(*sync.Map)
+}
+
+// write run fn under mapMux unless the Cache is frozen and report whether
+// it ran, fn must not call user hooks or write
+func (c *cache) write(fn func()) bool {
+	c.freezeMux.RLock()
+	defer c.freezeMux.RUnlock()
+	if c.frozen {
+		return false
+	}
+	c.mapMux.Lock()
+	defer c.mapMux.Unlock()
+	fn()
+	return true
+}
+
+// compareAndSwap store elm for key if old is still the stored element,
+// sync.Map only has CompareAndSwap since Go 1.20. Must be called inside write
+func (c *cache) compareAndSwap(key interface{}, old, elm *element) bool {
+	item, exist := c.mapping().Load(key)
+	if !exist || item.(*element) != old {
+		return false
+	}
+	c.mapping().Store(key, elm)
+	return true
+}
+
+// compareAndDelete delete key if old is still the stored element.
+// Must be called inside write
+func (c *cache) compareAndDelete(key interface{}, old *element) bool {
+	item, exist := c.mapping().Load(key)
+	if !exist || item.(*element) != old {
+		return false
+	}
+	c.mapping().Delete(key)
+	return true
 }
 
 func (c *cache) cleanup() {
-	c.mapping.Range(func(k, v interface{}) bool {
-		key := k.(string)
-		elm := v.(*element)
-		if time.Since(elm.Expired) > 0 {
-			c.mapping.Delete(key)
+	c.cleanupMux.Lock()
+	evicted := 0
+	now := time.Now()
+	c.write(func() {
+		c.mapping().Range(func(k, v interface{}) bool {
+			elm := v.(*element)
+			// the element may be replaced by Put since Range loaded it
+			if elm.isExpired(now) && c.compareAndDelete(k, elm) {
+				evicted++
+			}
+			return true
+		})
+	})
+	atomic.AddInt64(&c.deletes, int64(evicted))
+	// the logger may call CleanupNow, so don't hold cleanupMux for it
+	c.cleanupMux.Unlock()
+
+	if evicted > 0 {
+		c.log("debug", "evicted expired elements", map[string]interface{}{"count": evicted})
+	}
+}
+
+// Compact copy the live elements into a fresh map, so the memory held by
+// deleted keys can be released. Writes wait until it finishes, and it is a
+// no-op while frozen.
+func (c *cache) Compact() {
+	c.freezeMux.Lock()
+	defer c.freezeMux.Unlock()
+	if c.frozen {
+		return
+	}
+
+	fresh := &sync.Map{}
+	now := time.Now()
+	c.mapping().Range(func(k, v interface{}) bool {
+		if !v.(*element).isExpired(now) {
+			fresh.Store(k, v)
 		}
 		return true
 	})
+	c.store.Store(fresh)
+	atomic.StoreInt64(&c.deletes, 0)
 }
 
 type janitor struct {
 	interval time.Duration
+	delay    time.Duration
 	stop     chan struct{}
 }
 
 func (j *janitor) process(c *cache) {
+	if j.delay > 0 {
+		timer := time.NewTimer(j.delay)
+		select {
+		case <-timer.C:
+		case <-j.stop:
+			timer.Stop()
+			c.log("info", "janitor stopped", nil)
+			return
+		}
+	}
+
+	// heapC stays nil and never fires without WithHeapTarget
+	var heapC <-chan time.Time
+	if c.heapTarget > 0 && c.heapInterval > 0 {
+		heapTicker := time.NewTicker(c.heapInterval)
+		defer heapTicker.Stop()
+		heapC = heapTicker.C
+	}
+
 	ticker := time.NewTicker(j.interval)
+	c.log("info", "janitor started", map[string]interface{}{"interval": j.interval})
 	for {
 		select {
 		case <-ticker.C:
-			c.cleanup()
+			c.Cleanup()
+		case <-heapC:
+			c.shedHeap()
 		case <-j.stop:
 			ticker.Stop()
+			c.log("info", "janitor stopped", nil)
 			return
 		}
 	}
 }
 
 func stopJanitor(c *Cache) {
-	c.janitor.stop <- struct{}{}
+	close(c.janitor.stop)
 }
 
 // New return *Cache
-func New(interval time.Duration) *Cache {
+func New(interval time.Duration, options ...Option) *Cache {
 	j := &janitor{
 		interval: interval,
 		stop:     make(chan struct{}),
 	}
 	c := &cache{janitor: j}
-	go j.process(c)
+	c.store.Store(&sync.Map{})
+	for _, option := range options {
+		option(c)
+	}
+	if c.jitter > 0 {
+		j.delay = time.Duration(c.int63n(int64(c.jitter)))
+	}
 	C := &Cache{c}
+	if c.externalJanitor {
+		return C
+	}
+	go j.process(c)
+	for _, t := range c.tiers {
+		if t.interval > 0 {
+			go t.process(c, j.delay, j.stop)
+		}
+	}
 	runtime.SetFinalizer(C, stopJanitor)
 	return C
 }
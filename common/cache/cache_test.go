@@ -1,7 +1,14 @@
 package cache
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -68,3 +75,937 @@ func TestCache_AutoGC(t *testing.T) {
 	<-sign
 	runtime.GC()
 }
+
+func TestCache_LoadOrStore(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval)
+
+	actual, loaded := c.LoadOrStore("int", 1, ttl)
+	if loaded || actual.(int) != 1 {
+		t.Error("should store 1")
+	}
+
+	actual, loaded = c.LoadOrStore("int", 2, ttl)
+	if !loaded || actual.(int) != 1 {
+		t.Error("should load 1")
+	}
+
+	time.Sleep(ttl * 2)
+	actual, loaded = c.LoadOrStore("int", 3, ttl)
+	if loaded || actual.(int) != 3 {
+		t.Error("should replace expired element with 3")
+	}
+
+	if c.Get("int").(int) != 3 {
+		t.Error("should recv 3")
+	}
+}
+
+func TestCache_Logger(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	events := make(chan string, 16)
+	c := New(interval, WithLogger(func(level, msg string, fields map[string]interface{}) {
+		select {
+		case events <- msg:
+		default:
+		}
+	}))
+	c.Put("int", 1, ttl)
+
+	if msg := <-events; msg != "janitor started" {
+		t.Error("should log janitor started, instead of", msg)
+	}
+
+	select {
+	case msg := <-events:
+		if msg != "evicted expired elements" {
+			t.Error("should log eviction, instead of", msg)
+		}
+	case <-time.After(interval * 10):
+		t.Error("should log eviction")
+	}
+}
+
+func TestCache_RangeExpiringWithin(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("short", 1, 50*time.Millisecond)
+	c.Put("long", 2, time.Minute)
+
+	keys := []interface{}{}
+	c.RangeExpiringWithin(time.Second, func(key, value interface{}) bool {
+		keys = append(keys, key)
+		return true
+	})
+
+	if len(keys) != 1 || keys[0].(string) != "short" {
+		t.Error("should only visit short, instead of", keys)
+	}
+}
+
+func TestCache_ZeroTTL(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("zero", 1, 0)
+	c.Put("negative", 1, -time.Second)
+
+	if c.Get("zero") != nil || c.Get("negative") != nil {
+		t.Error("should ignore Put with ttl <= 0")
+	}
+
+	c.Put("int", 1, time.Minute)
+	c.Put("int", 2, 0)
+	if c.Get("int").(int) != 1 {
+		t.Error("should keep the previous element")
+	}
+}
+
+func TestCache_ZeroTTLMeansPermanent(t *testing.T) {
+	interval := 10 * time.Millisecond
+	c := New(interval, WithZeroTTLMeansPermanent(true))
+	c.Put("zero", 1, 0)
+	c.Put("negative", 2, -time.Second)
+
+	time.Sleep(interval * 2)
+	if c.Get("zero").(int) != 1 {
+		t.Error("should recv 1")
+	}
+
+	if c.Get("negative").(int) != 2 {
+		t.Error("should recv 2")
+	}
+
+	if _, expired := c.GetWithExpire("zero"); !expired.IsZero() {
+		t.Error("should never expire")
+	}
+}
+
+func TestCache_TouchPrefix(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval)
+	c.Put("fakeip:a", 1, ttl)
+	c.Put("fakeip:b", 2, ttl)
+	c.Put("other", 3, ttl)
+	c.Put(1, 4, ttl)
+
+	if n := c.TouchPrefix("fakeip:", time.Minute); n != 2 {
+		t.Error("should renew 2 elements, instead of", n)
+	}
+
+	time.Sleep(ttl * 2)
+	if n := c.TouchPrefix("other", time.Minute); n != 0 {
+		t.Error("should not resurrect expired element")
+	}
+
+	if c.Get("fakeip:a") == nil || c.Get("fakeip:b") == nil {
+		t.Error("should renew fakeip elements")
+	}
+
+	if c.Get("other") != nil || c.Get(1) != nil {
+		t.Error("should not renew other elements")
+	}
+}
+
+func TestCache_CleanupNow(t *testing.T) {
+	interval := time.Minute
+	ttl := 5 * time.Millisecond
+	var evicted int64
+	c := New(interval, WithLogger(func(level, msg string, fields map[string]interface{}) {
+		if count, ok := fields["count"]; ok {
+			atomic.AddInt64(&evicted, int64(count.(int)))
+		}
+	}))
+	c.Put("int", 1, ttl)
+	c.Put("string", "a", ttl)
+
+	time.Sleep(ttl * 2)
+	done := make(chan struct{})
+	go func() {
+		c.CleanupNow()
+		done <- struct{}{}
+	}()
+	c.CleanupNow()
+	<-done
+
+	if evicted := atomic.LoadInt64(&evicted); evicted != 2 {
+		t.Error("should evict 2 elements exactly once, instead of", evicted)
+	}
+}
+
+func TestCache_ValueCodec(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval,
+		WithValueEncoder(func(v interface{}) interface{} { return []byte(v.(string)) }),
+		WithValueDecoder(func(v interface{}) interface{} { return string(v.([]byte)) }),
+	)
+	c.Put("string", "a", ttl)
+
+	item, _ := c.mapping().Load("string")
+	if _, ok := item.(*element).Payload.([]byte); !ok {
+		t.Error("should store encoded payload")
+	}
+
+	if s := c.Get("string"); s.(string) != "a" {
+		t.Error("should recv 'a'")
+	}
+}
+
+func TestCache_PauseCleanup(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	c := New(interval)
+	c.PauseCleanup()
+	c.Put("int", 1, ttl)
+
+	time.Sleep(interval * 3)
+	if _, exist := c.mapping().Load("int"); !exist {
+		t.Error("should not sweep while paused")
+	}
+
+	c.ResumeCleanup()
+	time.Sleep(interval * 3)
+	if _, exist := c.mapping().Load("int"); exist {
+		t.Error("should sweep after resume")
+	}
+}
+
+func TestCache_GetOrDefault(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval)
+	c.Put("int", 1, ttl)
+
+	if i := c.GetOrDefault("int", 2); i.(int) != 1 {
+		t.Error("should recv 1")
+	}
+
+	if i := c.GetOrDefault("miss", 2); i.(int) != 2 {
+		t.Error("should recv default 2")
+	}
+
+	if c.Get("miss") != nil {
+		t.Error("should not store default")
+	}
+}
+
+func TestCache_Append(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			c.AppendBounded("slice", 0, time.Minute, i)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	if s := c.Get("slice").([]interface{}); len(s) != 100 {
+		t.Error("should keep all appends, instead of", len(s))
+	}
+
+	c.Put("int", 1, time.Minute)
+	if err := c.Append("int", 2); err != ErrNotSlice {
+		t.Error("should return ErrNotSlice")
+	}
+}
+
+func TestCache_AppendBounded(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("slice", []interface{}{1}, time.Minute)
+	_, expired := c.GetWithExpire("slice")
+
+	c.AppendBounded("slice", 2, time.Minute, 2, 3)
+	s, e := c.GetWithExpire("slice")
+	if len(s.([]interface{})) != 2 || s.([]interface{})[0].(int) != 2 {
+		t.Error("should trim the oldest items, instead of", s)
+	}
+
+	if !e.Equal(expired) {
+		t.Error("should preserve ttl")
+	}
+}
+
+func TestCache_CleanupJitter(t *testing.T) {
+	interval := 200 * time.Millisecond
+	jitter := time.Second
+	c := New(interval, WithCleanupJitter(jitter), WithRand(rand.New(rand.NewSource(1))))
+
+	expected := time.Duration(rand.New(rand.NewSource(1)).Int63n(int64(jitter)))
+	if c.janitor.delay != expected {
+		t.Error("should delay the first tick by", expected, "instead of", c.janitor.delay)
+	}
+}
+
+func TestCache_Freeze(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	c := New(interval)
+	c.Put("int", 1, ttl)
+	c.Freeze()
+	c.Put("string", "a", time.Minute)
+
+	if c.Get("string") != nil {
+		t.Error("should ignore Put while frozen")
+	}
+
+	if err := c.AppendBounded("slice", 0, time.Minute, 1); err != ErrFrozen {
+		t.Error("should return ErrFrozen")
+	}
+
+	time.Sleep(interval * 3)
+	if c.Get("int") != nil {
+		t.Error("should hide expired element")
+	}
+
+	if _, exist := c.mapping().Load("int"); !exist {
+		t.Error("should keep expired element while frozen")
+	}
+
+	c.Unfreeze()
+	if _, exist := c.mapping().Load("int"); exist {
+		t.Error("should drop expired element on Unfreeze")
+	}
+}
+
+func BenchmarkCache_Get(b *testing.B) {
+	c := New(time.Minute)
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = "fakeip:" + strconv.Itoa(i)
+		c.Put(keys[i], i, time.Minute)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Get(keys[i%len(keys)])
+	}
+}
+
+func TestCache_SizeWeightedTTL(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval, WithSizeWeightedTTL(func(v interface{}, baseTTL time.Duration) time.Duration {
+		if len(v.(string)) > 1 {
+			return baseTTL / 4
+		}
+		return baseTTL
+	}))
+	c.Put("small", "a", ttl)
+	c.Put("large", "abcd", ttl)
+
+	time.Sleep(ttl / 2)
+	if c.Get("small") == nil {
+		t.Error("should keep small payload")
+	}
+
+	if c.Get("large") != nil {
+		t.Error("should expire large payload sooner")
+	}
+}
+
+func TestCache_RangeContext(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	for i := 0; i < rangeCheckInterval*4; i++ {
+		c.Put(i, i, time.Minute)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	visited := 0
+	err := c.RangeContext(ctx, func(key, value interface{}) bool {
+		visited++
+		cancel()
+		return true
+	})
+
+	if err != context.Canceled {
+		t.Error("should return context.Canceled, instead of", err)
+	}
+
+	if visited >= rangeCheckInterval*4 {
+		t.Error("should stop early")
+	}
+}
+
+func TestCache_ExternalScheduler(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	c := New(interval, WithExternalScheduler())
+	c.Put("int", 1, ttl)
+
+	time.Sleep(interval * 3)
+	if _, exist := c.mapping().Load("int"); !exist {
+		t.Error("should not sweep without Cleanup")
+	}
+
+	c.Cleanup()
+	if _, exist := c.mapping().Load("int"); exist {
+		t.Error("should sweep on Cleanup")
+	}
+}
+
+func TestCache_Swap(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("old", 1, time.Minute)
+
+	other := New(interval)
+	other.Put("new", 2, time.Minute)
+	_, expired := other.GetWithExpire("new")
+
+	c.Swap(other)
+	if c.Get("old") != nil {
+		t.Error("should displace old elements")
+	}
+
+	i, e := c.GetWithExpire("new")
+	if i.(int) != 2 || !e.Equal(expired) {
+		t.Error("should recv 2 with the same expire time")
+	}
+
+	if other.Get("old").(int) != 1 {
+		t.Error("should hand old elements to other")
+	}
+}
+
+func TestCache_WithLock(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			c.WithLock("int", func(value interface{}, exists bool) (interface{}, time.Duration, bool) {
+				if !exists {
+					return 1, time.Minute, true
+				}
+				return value.(int) + 1, time.Minute, true
+			})
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if i := c.Get("int"); i.(int) != 100 {
+		t.Error("should recv 100, instead of", i)
+	}
+
+	if len(c.keyLocks) != 0 {
+		t.Error("should release all key locks")
+	}
+}
+
+func TestCache_TrimToPercent(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval, WithZeroTTLMeansPermanent(true))
+	c.Put("permanent", 0, 0)
+	for i := 1; i < 10; i++ {
+		c.Put(i, i, time.Duration(i)*time.Minute)
+	}
+
+	if n := c.TrimToPercent(0.5); n != 5 {
+		t.Error("should drop 5 elements, instead of", n)
+	}
+
+	if c.Get(5) != nil || c.Get(6) == nil {
+		t.Error("should drop soonest-to-expire elements first")
+	}
+
+	if c.Get("permanent") == nil {
+		t.Error("should drop permanent element last")
+	}
+}
+
+func TestCache_HeapTarget(t *testing.T) {
+	interval := time.Minute
+	check := 10 * time.Millisecond
+	c := New(interval, WithHeapTarget(1, check))
+	for i := 0; i < 100; i++ {
+		c.Put(i, make([]byte, 1024), time.Minute)
+	}
+
+	time.Sleep(check * 5)
+	if keys := c.OrderedKeys(); len(keys) != 0 {
+		t.Error("should drop all elements above the heap target, instead of", len(keys))
+	}
+}
+
+type stringCodec struct{}
+
+func (stringCodec) Marshal(v interface{}) ([]byte, error) {
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("not a string")
+	}
+	return []byte(s), nil
+}
+
+func (stringCodec) Unmarshal(data []byte) (interface{}, error) {
+	return string(data), nil
+}
+
+func TestCache_ValueSerialization(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval, WithValueSerialization(stringCodec{}))
+	c.Put("string", "a", ttl)
+	c.Put("int", 1, ttl)
+
+	item, _ := c.mapping().Load("string")
+	if _, ok := item.(*element).Payload.([]byte); !ok {
+		t.Error("should store serialized payload")
+	}
+
+	if s := c.Get("string"); s.(string) != "a" {
+		t.Error("should recv 'a'")
+	}
+
+	if c.Get("int") != nil {
+		t.Error("should drop payload failing to marshal")
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (interface{}, error) {
+	v := map[string]interface{}{}
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+func BenchmarkCache_ValueSerialization(b *testing.B) {
+	payload := map[string]interface{}{"ip": "198.18.0.1", "host": "example.com", "ttl": 600}
+	benchmarks := []struct {
+		name    string
+		options []Option
+	}{
+		{"Plain", nil},
+		{"Serialized", []Option{WithValueSerialization(jsonCodec{})}},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			c := New(time.Minute, bm.options...)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				c.Put("key", payload, time.Minute)
+				c.Get("key")
+			}
+		})
+	}
+}
+
+func TestCache_Warm(t *testing.T) {
+	interval := 200 * time.Millisecond
+	spread := time.Minute
+	c := New(interval, WithRand(rand.New(rand.NewSource(1))))
+	entries := []Entry{}
+	for i := 0; i < 10; i++ {
+		entries = append(entries, Entry{Key: i, Payload: i, TTL: time.Minute})
+	}
+	c.Warm(entries, spread)
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		_, expired := c.GetWithExpire(i)
+		ttl := time.Minute + time.Duration(r.Int63n(int64(spread)))
+		if d := time.Until(expired) - ttl; d > 0 || d < -time.Second {
+			t.Error("should spread ttl by the injected rand, instead of", time.Until(expired))
+		}
+	}
+}
+
+func TestCache_PutTiered(t *testing.T) {
+	interval := time.Minute
+	tierInterval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	c := New(interval, WithTiers(tierInterval))
+	c.PutTiered("short", 1, ttl, 1)
+	c.Put("untiered", 2, ttl)
+
+	time.Sleep(tierInterval * 3)
+	if _, exist := c.mapping().Load("short"); exist {
+		t.Error("should sweep tiered element at the tier interval")
+	}
+
+	if _, exist := c.mapping().Load("untiered"); !exist {
+		t.Error("should leave untiered element to the main janitor")
+	}
+}
+
+func TestCache_PutTieredJitter(t *testing.T) {
+	interval := time.Minute
+	tierInterval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	// the seed delays the first tick by about 950ms
+	c := New(interval, WithTiers(tierInterval), WithCleanupJitter(time.Second), WithRand(rand.New(rand.NewSource(1))))
+	c.PutTiered("short", 1, ttl, 1)
+
+	time.Sleep(tierInterval * 3)
+	if _, exist := c.mapping().Load("short"); !exist {
+		t.Error("should delay the tier sweep by the jitter")
+	}
+}
+
+func TestCache_GetExpired(t *testing.T) {
+	interval := time.Minute
+	ttl := 5 * time.Millisecond
+	c := New(interval)
+	c.Put("int", 1, ttl)
+
+	time.Sleep(ttl * 2)
+	i, expired, present := c.GetExpired("int")
+	if !present || !expired || i.(int) != 1 {
+		t.Error("should recv expired 1")
+	}
+
+	c.CleanupNow()
+	if _, _, present := c.GetExpired("int"); present {
+		t.Error("should not be present after cleanup")
+	}
+}
+
+func TestCache_AutoCompact(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := time.Millisecond
+	threshold := 100
+	c := New(interval, WithAutoCompact(threshold))
+	before := c.mapping()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < threshold; i++ {
+			c.Put(strconv.Itoa(round)+":"+strconv.Itoa(i), i, ttl)
+		}
+		time.Sleep(interval * 3)
+
+		if n := atomic.LoadInt64(&c.deletes); n >= int64(threshold) {
+			t.Fatal("should compact after the threshold, instead of", n, "deletes")
+		}
+
+		if keys := c.OrderedKeys(); len(keys) != 0 {
+			t.Fatal("should not keep churned elements, instead of", len(keys))
+		}
+	}
+
+	if c.mapping() == before {
+		t.Error("should replace the backing map on compact")
+	}
+}
+
+func TestCache_BloomFilter(t *testing.T) {
+	interval := 10 * time.Millisecond
+	ttl := 5 * time.Millisecond
+	c := New(interval, WithBloomFilter(1000, 0.01))
+	c.Put("int", 1, time.Minute)
+	c.Put("short", 2, ttl)
+
+	if !c.MightContain("int") || !c.MightContain("short") {
+		t.Error("should never report a stored key as absent")
+	}
+
+	misses := 0
+	for i := 0; i < 1000; i++ {
+		if !c.MightContain("miss:" + strconv.Itoa(i)) {
+			misses++
+		}
+	}
+	if misses < 900 {
+		t.Error("should rule out most misses, instead of", misses)
+	}
+
+	time.Sleep(interval * 3)
+	if c.MightContain("short") {
+		t.Error("should drop expired keys on rebuild")
+	}
+
+	if ratio := c.BloomFillRatio(); ratio <= 0 || ratio >= 1 {
+		t.Error("should report fill ratio, instead of", ratio)
+	}
+
+	if !c.MightContain("int") {
+		t.Error("should keep live keys after rebuild")
+	}
+}
+
+func TestCache_MinWriteInterval(t *testing.T) {
+	interval := 200 * time.Millisecond
+	minWrite := 20 * time.Millisecond
+	c := New(interval, WithMinWriteInterval(minWrite))
+	c.Put("int", 1, time.Minute)
+	c.Put("int", 2, time.Minute)
+
+	if i := c.Get("int"); i.(int) != 1 {
+		t.Error("should drop the second Put, instead of", i)
+	}
+
+	if n := c.SuppressedWrites(); n != 1 {
+		t.Error("should count 1 suppressed write, instead of", n)
+	}
+
+	time.Sleep(minWrite * 2)
+	c.Put("int", 3, time.Minute)
+	if i := c.Get("int"); i.(int) != 3 {
+		t.Error("should accept Put after the interval, instead of", i)
+	}
+}
+
+func TestCache_EventHistory(t *testing.T) {
+	interval := time.Minute
+	c := New(interval, WithEventHistory(2), WithZeroTTLMeansPermanent(true))
+	for i := 0; i < 3; i++ {
+		c.Put(i, i, 0)
+		c.TrimToPercent(0)
+	}
+
+	events := c.RecentEvents()
+	if len(events) != 2 {
+		t.Fatal("should keep the last 2 events, instead of", len(events))
+	}
+
+	if events[0].Message != "trimmed elements" || events[0].Time.After(events[1].Time) {
+		t.Error("should return events from oldest to newest")
+	}
+}
+
+func TestCache_LoadOrStoreRaceGet(t *testing.T) {
+	interval := time.Minute
+	ttl := time.Millisecond
+	c := New(interval)
+
+	for round := 0; round < 50; round++ {
+		c.Put("int", -1, ttl)
+		time.Sleep(ttl * 2)
+
+		var stored int32
+		wg := sync.WaitGroup{}
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func(i int) {
+				if _, loaded := c.LoadOrStore("int", i, time.Minute); !loaded {
+					atomic.AddInt32(&stored, 1)
+				}
+				wg.Done()
+			}(i)
+			go func() {
+				c.Get("int")
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+
+		if stored != 1 {
+			t.Fatal("should store exactly once, instead of", stored)
+		}
+
+		if c.Get("int") == nil {
+			t.Fatal("should not drop the stored element")
+		}
+	}
+}
+
+func TestCache_BloomFilterPutDuringRebuild(t *testing.T) {
+	interval := time.Minute
+	c := New(interval, WithBloomFilter(10000, 0.01))
+
+	done := make(chan struct{})
+	rebuilt := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				close(rebuilt)
+				return
+			default:
+				c.write(c.rebuildBloom)
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(g) + ":" + strconv.Itoa(i)
+				c.Put(key, i, time.Minute)
+				if !c.MightContain(key) {
+					t.Error("should never report a stored key as absent:", key)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(done)
+	<-rebuilt
+}
+
+func TestCache_AutoCompactExternalScheduler(t *testing.T) {
+	interval := time.Minute
+	ttl := time.Millisecond
+	threshold := 100
+	c := New(interval, WithExternalScheduler(), WithAutoCompact(threshold))
+	before := c.mapping()
+
+	for i := 0; i < threshold; i++ {
+		c.Put(i, i, ttl)
+	}
+	time.Sleep(ttl * 2)
+	c.Cleanup()
+
+	if n := atomic.LoadInt64(&c.deletes); n != 0 {
+		t.Error("should compact on Cleanup, instead of", n, "deletes")
+	}
+
+	if c.mapping() == before {
+		t.Error("should replace the backing map on compact")
+	}
+}
+
+func TestCache_BloomFilterExternalScheduler(t *testing.T) {
+	interval := time.Minute
+	ttl := time.Millisecond
+	c := New(interval, WithExternalScheduler(), WithBloomFilter(1000, 0.01))
+	c.Put("short", 1, ttl)
+
+	time.Sleep(ttl * 2)
+	c.Cleanup()
+	if c.MightContain("short") {
+		t.Error("should rebuild the filter on Cleanup")
+	}
+}
+
+func TestCache_PutTieredExternalScheduler(t *testing.T) {
+	interval := time.Minute
+	ttl := time.Millisecond
+	c := New(interval, WithExternalScheduler(), WithTiers(0, time.Second))
+	c.PutTiered("zero", 1, ttl, 1)
+	c.PutTiered("short", 2, ttl, 2)
+
+	time.Sleep(ttl * 2)
+	c.Cleanup()
+	for _, tier := range c.tiers {
+		tier.index.Range(func(k, v interface{}) bool {
+			t.Error("should drop index entry on Cleanup:", k)
+			return true
+		})
+	}
+}
+
+func TestCache_WarmZeroTTL(t *testing.T) {
+	interval := 200 * time.Millisecond
+	entries := []Entry{{Key: "zero", Payload: 1, TTL: 0}}
+
+	c := New(interval)
+	c.Warm(entries, time.Minute)
+	if c.Get("zero") != nil {
+		t.Error("should reject ttl <= 0 without spreading it")
+	}
+
+	c = New(interval, WithZeroTTLMeansPermanent(true))
+	c.Warm(entries, time.Minute)
+	if _, expired := c.GetWithExpire("zero"); !expired.IsZero() {
+		t.Error("should keep ttl <= 0 permanent")
+	}
+}
+
+func TestCache_AppendCreateTTL(t *testing.T) {
+	interval := 200 * time.Millisecond
+	ttl := 20 * time.Millisecond
+	c := New(interval)
+
+	if err := c.Append("absent", 1); err != ErrRejectedTTL || c.Get("absent") != nil {
+		t.Error("should reject an element without expiration by default")
+	}
+
+	c.AppendBounded("slice", 0, ttl, 1)
+	if _, expired := c.GetWithExpire("slice"); expired.IsZero() {
+		t.Error("should create the element with its ttl")
+	}
+
+	time.Sleep(ttl * 2)
+	if c.Get("slice") != nil {
+		t.Error("should expire the created element")
+	}
+
+	c = New(interval, WithZeroTTLMeansPermanent(true))
+	c.Append("permanent", 1)
+	if _, expired := c.GetWithExpire("permanent"); c.Get("permanent") == nil || !expired.IsZero() {
+		t.Error("should create permanent element with WithZeroTTLMeansPermanent")
+	}
+}
+
+func TestCache_SwapFrozen(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("old", 1, time.Minute)
+
+	other := New(interval)
+	other.Put("new", 2, time.Minute)
+	other.Freeze()
+
+	c.Swap(other)
+	if c.Get("old") == nil || other.Get("new") == nil {
+		t.Error("should not swap with a frozen cache")
+	}
+}
+
+func TestCache_RangeContextCanceled(t *testing.T) {
+	interval := 200 * time.Millisecond
+	c := New(interval)
+	c.Put("int", 1, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.RangeContext(ctx, func(key, value interface{}) bool {
+		t.Error("should not visit elements with a canceled context")
+		return true
+	})
+
+	if err != context.Canceled {
+		t.Error("should return context.Canceled, instead of", err)
+	}
+}
+
+func TestCache_CleanupLoggerReentrant(t *testing.T) {
+	interval := time.Minute
+	ttl := time.Millisecond
+	var c *Cache
+	reentered := false
+	c = New(interval, WithLogger(func(level, msg string, fields map[string]interface{}) {
+		if msg == "evicted expired elements" && !reentered {
+			reentered = true
+			c.CleanupNow()
+		}
+	}))
+	c.Put("int", 1, ttl)
+
+	time.Sleep(ttl * 2)
+	done := make(chan struct{})
+	go func() {
+		c.CleanupNow()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("should not deadlock when the logger calls CleanupNow")
+	}
+}
@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Event is a notable event of the Cache, the same as reported to WithLogger
+type Event struct {
+	Time    time.Time
+	Level   string
+	Message string
+	Fields  map[string]interface{}
+}
+
+// eventRing keep the last events, it is only written on janitor, trim and
+// error paths so a plain mutex stays off the Get and Put hot paths
+type eventRing struct {
+	events []Event
+	next   int
+	full   bool
+	mux    sync.Mutex
+}
+
+// WithEventHistory keep the last n events for RecentEvents
+func WithEventHistory(n int) Option {
+	return func(c *cache) {
+		if n > 0 {
+			c.history = &eventRing{events: make([]Event, n)}
+		}
+	}
+}
+
+// RecentEvents return the kept events from oldest to newest, nil without
+// WithEventHistory
+func (c *cache) RecentEvents() []Event {
+	if c.history == nil {
+		return nil
+	}
+	return c.history.list()
+}
+
+func (r *eventRing) add(e Event) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.events[r.next] = e
+	r.next = (r.next + 1) % len(r.events)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+func (r *eventRing) list() []Event {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if !r.full {
+		return append([]Event{}, r.events[:r.next]...)
+	}
+	return append(append([]Event{}, r.events[r.next:]...), r.events[:r.next]...)
+}
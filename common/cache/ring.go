@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Ring map keys to nodes with consistent hashing, so adding or removing a
+// node only moves the keys of that node
+type Ring struct {
+	replicas int
+	hashes   []uint32
+	// owners holds the sorted nodes placed on each point, the smallest one
+	// owns it so a collision doesn't depend on the order of Add
+	owners map[uint32][]string
+	mux    sync.RWMutex
+}
+
+// Get return the node of the key, or "" if the Ring is empty
+func (r *Ring) Get(key string) string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	idx := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if idx == len(r.hashes) {
+		idx = 0
+	}
+	return r.owners[r.hashes[idx]][0]
+}
+
+// Add put nodes into the Ring
+func (r *Ring) Add(nodes ...string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			owners, exist := r.owners[hash]
+			if !exist {
+				r.hashes = append(r.hashes, hash)
+			}
+			idx := sort.SearchStrings(owners, node)
+			if idx < len(owners) && owners[idx] == node {
+				continue
+			}
+			owners = append(owners, "")
+			copy(owners[idx+1:], owners[idx:])
+			owners[idx] = node
+			r.owners[hash] = owners
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+}
+
+// Remove drop nodes from the Ring
+func (r *Ring) Remove(nodes ...string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	removed := map[string]bool{}
+	for _, node := range nodes {
+		removed[node] = true
+	}
+
+	hashes := r.hashes[:0]
+	for _, hash := range r.hashes {
+		owners := r.owners[hash][:0]
+		for _, node := range r.owners[hash] {
+			if !removed[node] {
+				owners = append(owners, node)
+			}
+		}
+		if len(owners) == 0 {
+			delete(r.owners, hash)
+			continue
+		}
+		r.owners[hash] = owners
+		hashes = append(hashes, hash)
+	}
+	r.hashes = hashes
+}
+
+// NewRing return *Ring with every node placed replicas times
+func NewRing(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = 1
+	}
+	r := &Ring{
+		replicas: replicas,
+		owners:   map[uint32][]string{},
+	}
+	r.Add(nodes...)
+	return r
+}
@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRing_Basic(t *testing.T) {
+	r := NewRing([]string{"a", "b", "c"}, 50)
+
+	if r.Get("key") != r.Get("key") {
+		t.Error("should return the same node")
+	}
+
+	r.Remove("a", "b", "c")
+	if node := r.Get("key"); node != "" {
+		t.Error("should return empty node, instead of", node)
+	}
+}
+
+func TestRing_Add(t *testing.T) {
+	r := NewRing([]string{"a", "b", "c"}, 50)
+
+	total := 10000
+	before := make([]string, total)
+	for i := range before {
+		before[i] = r.Get(strconv.Itoa(i))
+	}
+
+	r.Add("d")
+	moved := 0
+	for i := range before {
+		node := r.Get(strconv.Itoa(i))
+		if node == before[i] {
+			continue
+		}
+		if node != "d" {
+			t.Fatal("should only move keys to the new node")
+		}
+		moved++
+	}
+
+	// a new node should take about 1/4 of the keys
+	if moved == 0 || moved > total/2 {
+		t.Error("should move a bounded number of keys, instead of", moved)
+	}
+}
+
+func TestRing_Order(t *testing.T) {
+	nodes := []string{"1.2.3.4", "11.2.3.4", "a", "b", "c"}
+	reversed := make([]string, len(nodes))
+	for i, node := range nodes {
+		reversed[len(nodes)-1-i] = node
+	}
+
+	r := NewRing(nodes, 20)
+	other := NewRing(reversed, 20)
+	for i := 0; i < 10000; i++ {
+		key := strconv.Itoa(i)
+		if r.Get(key) != other.Get(key) {
+			t.Fatal("should map keys the same way in any node order, key", key)
+		}
+	}
+}
+
+func TestRing_RemoveCollision(t *testing.T) {
+	r := NewRing([]string{"a", "b"}, 1)
+	hash := r.hashes[0]
+	// fake a collision of a and b on the first point
+	r.owners[hash] = []string{"a", "b"}
+
+	r.Remove("a")
+	if owners := r.owners[hash]; len(owners) != 1 || owners[0] != "b" {
+		t.Error("should restore the other owner, instead of", owners)
+	}
+}
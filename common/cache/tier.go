@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tier index the elements Put by PutTiered, so its own janitor only sweeps
+// them instead of the whole Cache
+type tier struct {
+	interval time.Duration
+	// index map key to the *element stored by PutTiered
+	index sync.Map
+}
+
+// WithTiers add cleanup tiers numbered from 1, tier i is swept every
+// intervals[i-1] in addition to the sweep of the whole Cache every interval
+// given to New (tier 0). Put short-lived elements in a tier with a short
+// interval so they are dropped promptly, and keep the New interval long.
+// Every janitor tick (or Cleanup with WithExternalScheduler) also sweeps all
+// tiers, and a tier with an interval <= 0 is only swept then.
+func WithTiers(intervals ...time.Duration) Option {
+	return func(c *cache) {
+		for _, interval := range intervals {
+			c.tiers = append(c.tiers, &tier{interval: interval})
+		}
+	}
+}
+
+// PutTiered Put the element and sweep it at the cadence of the tier, see
+// WithTiers. An unknown tier is tier 0, which is the same as Put.
+func (c *cache) PutTiered(key interface{}, payload interface{}, ttl time.Duration, tier int) {
+	elm, ok := c.put(key, payload, ttl)
+	if !ok || tier <= 0 || tier > len(c.tiers) {
+		return
+	}
+	c.tiers[tier-1].index.Store(key, elm)
+}
+
+func (t *tier) cleanup(c *cache) {
+	if atomic.LoadInt32(&c.paused) != 0 {
+		return
+	}
+
+	evicted := 0
+	now := time.Now()
+	c.write(func() {
+		t.index.Range(func(k, v interface{}) bool {
+			elm := v.(*element)
+			item, exist := c.mapping().Load(k)
+			switch {
+			case !exist || item.(*element) != elm:
+				// dropped or replaced since PutTiered
+				t.index.Delete(k)
+			case elm.isExpired(now):
+				if c.compareAndDelete(k, elm) {
+					evicted++
+				}
+				t.index.Delete(k)
+			}
+			return true
+		})
+	})
+	atomic.AddInt64(&c.deletes, int64(evicted))
+	if evicted > 0 {
+		c.log("debug", "evicted expired elements", map[string]interface{}{"count": evicted, "tier_interval": t.interval})
+	}
+}
+
+// process sweep the tier every interval after delay, the janitor jitter
+func (t *tier) process(c *cache, delay time.Duration, stop chan struct{}) {
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.cleanup(c)
+		case <-stop:
+			return
+		}
+	}
+}